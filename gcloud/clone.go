@@ -0,0 +1,213 @@
+/*
+Copyright 2016 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	cloneModeCopy     = "copy"
+	cloneModeHardlink = "hardlink"
+	cloneModeFresh    = "fresh"
+
+	// Where component tarballs for "fresh" installs are fetched from.
+	// Each component is published as "<id>-<version>.tar.gz".
+	componentRepoBaseURL = "https://dl.google.com/dl/cloudsdk/channel/rapid/components"
+)
+
+// cloneSDK lays out a new SDK tree at dst based on the SDK at src, using
+// the given mode. It's the single entry point installVersion uses
+// regardless of which --mode was requested.
+func cloneSDK(mode, src, dst, version string) error {
+	switch mode {
+	case "", cloneModeCopy:
+		return exec.Command("cp", "-r", src, dst).Run()
+	case cloneModeHardlink:
+		return hardlinkClone(src, dst)
+	case cloneModeFresh:
+		return freshClone(src, dst, version)
+	default:
+		return fmt.Errorf("unknown install mode %q", mode)
+	}
+}
+
+// hardlinkClone recreates src's directory structure at dst, hardlinking
+// every regular file instead of copying its contents. This is safe because
+// `gcloud components update` rewrites files wholesale rather than editing
+// them in place, so the source tree is never mutated through the link.
+// Files that can't be hardlinked because dst is on a different filesystem
+// (EXDEV) fall back to a plain copy; any other link error is returned.
+func hardlinkClone(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode())
+		case info.Mode()&os.ModeSymlink != 0:
+			linkDest, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(linkDest, target)
+		default:
+			if err := os.Link(path, target); err != nil {
+				if linkErr, ok := err.(*os.LinkError); ok && linkErr.Err == syscall.EXDEV {
+					return copyFile(path, target, info.Mode())
+				}
+				return err
+			}
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// sourceManifest is the subset of the installed SDK's component manifest
+// that freshClone needs: which components are actually present in src, so
+// the fresh install doesn't pull down components the source never had.
+type sourceManifest struct {
+	Components []struct {
+		ID string `json:"id"`
+	} `json:"components"`
+}
+
+func readSourceManifest(src string) (*sourceManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(src, ".install", "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read component manifest: %v", err)
+	}
+	var m sourceManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("could not parse component manifest: %v", err)
+	}
+	return &m, nil
+}
+
+// freshClone skips cloning the source SDK tree entirely and instead
+// downloads the pinned version's component tarballs directly, laying out a
+// minimal SDK containing only the components the source manifest lists.
+func freshClone(src, dst, version string) error {
+	manifest, err := readSourceManifest(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, c := range manifest.Components {
+		if err := downloadComponent(c.ID, version, dst); err != nil {
+			return fmt.Errorf("could not install component %q: %v", c.ID, err)
+		}
+	}
+	return nil
+}
+
+// downloadComponent fetches "<id>-<version>.tar.gz" from
+// componentRepoBaseURL and extracts it into destDir.
+func downloadComponent(id, version, destDir string) error {
+	url := fmt.Sprintf("%s/%s-%s.tar.gz", componentRepoBaseURL, id, version)
+	resp, err := http.Get(url)
+	if err != nil {
+		return fmt.Errorf("could not fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not fetch %s: %s", url, resp.Status)
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read %s as gzip: %v", url, err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read %s as tar: %v", url, err)
+		}
+		target := filepath.Join(destDir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		}
+	}
+}
+
+// checkInstalledVersion runs "bin/gcloud version --format=json" in sdkDir
+// (via reportedGcloudVersion) and confirms it reports wantVersion, so a corrupt or partial install (of any mode) is
+// caught before it's moved into place.
+func checkInstalledVersion(sdkDir, wantVersion string) error {
+	got, err := reportedGcloudVersion(filepath.Join(sdkDir, "bin", "gcloud"))
+	if err != nil {
+		return fmt.Errorf("could not verify installed version: %v", err)
+	}
+	if got != wantVersion {
+		return fmt.Errorf("installed SDK reports version %q, wanted %q", got, wantVersion)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+/*
+Copyright 2016 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The structured config file, an alternative to pins.cfg. It is a YAML
+// document of the shape:
+//
+//	default_version: stable
+//
+//	versions:
+//	  beta: /opt/sdks/beta-track
+//	  prod: 459.0.0
+//
+//	pins:
+//	  - pattern: gcloud beta run deploy
+//	    version: prod
+//	    extra_args: [--quiet]
+//	    env:
+//	      CLOUDSDK_CORE_PROJECT: my-project
+//
+//	plugins:
+//	  - kubectl
+//
+// versions lets one named version be reused by many pins, so bumping it in
+// one place updates everything that references it; a version entry's value
+// may itself be a path, a raw SDK version, or "latest"/"stable".
+const structuredConfigFile = "pincloud.yaml"
+
+// ConfigPin is one entry in the structured config's pins list.
+type ConfigPin struct {
+	Pattern   string
+	Version   string
+	ExtraArgs []string
+	Env       map[string]string
+}
+
+// StructuredConfig is the parsed structured config file.
+type StructuredConfig struct {
+	DefaultVersion string
+	Versions       map[string]string
+	Pins           []ConfigPin
+	Plugins        []string
+}
+
+func structuredConfigPath() string {
+	return filepath.Join(getConfigDirectory(), structuredConfigFile)
+}
+
+// structuredConfigPlugins returns the plugins list from the structured
+// config, or nil if there is no structured config (e.g. pins.cfg is in
+// use instead).
+func structuredConfigPlugins() []string {
+	data, err := ioutil.ReadFile(structuredConfigPath())
+	if err != nil {
+		return nil
+	}
+	cfg, err := parseStructuredConfig(data)
+	if err != nil {
+		log.Printf("Could not parse %q: %v", structuredConfigPath(), err)
+		return nil
+	}
+	return cfg.Plugins
+}
+
+// loadPinConfigLocked loads pin configuration from whichever source is
+// configured: the structured config file if present, else the legacy
+// pins.cfg. It returns the resolved pin list and, if default_version was
+// set in a structured config, the gcloud binary it resolves to. It assumes
+// any necessary locking has already been done by the caller.
+func loadPinConfigLocked() (PinList, string, error) {
+	data, err := ioutil.ReadFile(structuredConfigPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, "", fmt.Errorf("could not read %q: %v", structuredConfigPath(), err)
+		}
+		fin, err := os.Open(getPinsPath())
+		if err != nil {
+			return nil, "", fmt.Errorf("could not open pin config: %v", err)
+		}
+		defer fin.Close()
+		plist, err := loadPinsLocked(fin)
+		return plist, "", err
+	}
+
+	cfg, err := parseStructuredConfig(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not parse %q: %v", structuredConfigPath(), err)
+	}
+	plist, err := cfg.toPinList()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var defaultGcloud string
+	if cfg.DefaultVersion != "" {
+		defaultGcloud, err = cfg.resolveVersion(cfg.DefaultVersion)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not resolve default_version %q: %v", cfg.DefaultVersion, err)
+		}
+	}
+	return plist, defaultGcloud, nil
+}
+
+// loadPinConfig is loadPinConfigLocked wrapped in the shared pincloud lock,
+// for callers (namely Run) that aren't already holding it.
+func loadPinConfig() (PinList, string, error) {
+	lock, err := acquireLock(false)
+	if err != nil {
+		return nil, "", err
+	}
+	defer releaseLock(lock)
+	return loadPinConfigLocked()
+}
+
+// resolveVersion turns a version or a name from cfg.Versions into the
+// ".../bin/gcloud" path mapCommand expects, resolving "latest"/"stable"
+// against the remote index along the way.
+func (cfg *StructuredConfig) resolveVersion(v string) (string, error) {
+	if named, ok := cfg.Versions[v]; ok {
+		v = named
+	}
+	resolved, err := resolveVersionToken(v)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(getVersionsDirectory(), resolved)
+	}
+	return filepath.Join(resolved, "bin", "gcloud"), nil
+}
+
+func (cfg *StructuredConfig) toPinList() (PinList, error) {
+	var plist PinList
+	for _, cp := range cfg.Pins {
+		pattern, err := shlex(cp.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("could not shlex pattern %q: %v", cp.Pattern, err)
+		}
+		if len(pattern) == 0 || pattern[0] != "gcloud" {
+			return nil, fmt.Errorf("pin pattern must start with 'gcloud': %q", cp.Pattern)
+		}
+		gcloud, err := cfg.resolveVersion(cp.Version)
+		if err != nil {
+			return nil, fmt.Errorf("pin %q: %v", cp.Pattern, err)
+		}
+		args := append([]string{gcloud}, cp.ExtraArgs...)
+		plist = append(plist, Pin{Pattern: pattern, Args: args, Env: cp.Env})
+	}
+	return plist, nil
+}
+
+// parseStructuredConfig parses the restricted subset of YAML the structured
+// config needs: top-level scalars and maps, a "pins" list of maps (whose
+// "env" field is itself a nested map), and inline "[a, b]" lists. It is
+// intentionally not a general-purpose YAML parser.
+func parseStructuredConfig(data []byte) (*StructuredConfig, error) {
+	cfg := &StructuredConfig{Versions: map[string]string{}}
+
+	const (
+		sectionNone = iota
+		sectionVersions
+		sectionPins
+		sectionPlugins
+	)
+	section := sectionNone
+	var curPin *ConfigPin
+	inEnv := false
+
+	flushPin := func() {
+		if curPin != nil {
+			cfg.Pins = append(cfg.Pins, *curPin)
+			curPin = nil
+		}
+	}
+
+	for lineNum, raw := range strings.Split(string(data), "\n") {
+		line := stripYAMLComment(raw)
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		trimmed := strings.TrimSpace(line)
+
+		if indent == 0 {
+			flushPin()
+			inEnv = false
+			switch {
+			case trimmed == "versions:":
+				section = sectionVersions
+			case trimmed == "pins:":
+				section = sectionPins
+			case trimmed == "plugins:":
+				section = sectionPlugins
+			case strings.HasPrefix(trimmed, "default_version:"):
+				cfg.DefaultVersion = unquoteYAML(strings.TrimSpace(strings.TrimPrefix(trimmed, "default_version:")))
+				section = sectionNone
+			default:
+				return nil, fmt.Errorf("line %d: unrecognized top-level key %q", lineNum+1, trimmed)
+			}
+			continue
+		}
+
+		switch section {
+		case sectionVersions:
+			kv := strings.SplitN(trimmed, ":", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("line %d: malformed versions entry %q", lineNum+1, trimmed)
+			}
+			cfg.Versions[strings.TrimSpace(kv[0])] = unquoteYAML(strings.TrimSpace(kv[1]))
+		case sectionPlugins:
+			if !strings.HasPrefix(trimmed, "- ") {
+				return nil, fmt.Errorf("line %d: malformed plugins entry %q", lineNum+1, trimmed)
+			}
+			cfg.Plugins = append(cfg.Plugins, unquoteYAML(strings.TrimPrefix(trimmed, "- ")))
+		case sectionPins:
+			if strings.HasPrefix(trimmed, "- ") {
+				flushPin()
+				curPin = &ConfigPin{Env: map[string]string{}}
+				inEnv = false
+				trimmed = strings.TrimPrefix(trimmed, "- ")
+			}
+			if curPin == nil {
+				return nil, fmt.Errorf("line %d: pin field outside of a list item: %q", lineNum+1, trimmed)
+			}
+			if trimmed == "env:" {
+				inEnv = true
+				continue
+			}
+			if inEnv {
+				kv := strings.SplitN(trimmed, ":", 2)
+				if len(kv) != 2 {
+					return nil, fmt.Errorf("line %d: malformed env entry %q", lineNum+1, trimmed)
+				}
+				curPin.Env[strings.TrimSpace(kv[0])] = unquoteYAML(strings.TrimSpace(kv[1]))
+				continue
+			}
+			kv := strings.SplitN(trimmed, ":", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("line %d: malformed pin entry %q", lineNum+1, trimmed)
+			}
+			key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			switch key {
+			case "pattern":
+				curPin.Pattern = unquoteYAML(val)
+			case "version":
+				curPin.Version = unquoteYAML(val)
+			case "extra_args":
+				curPin.ExtraArgs = parseInlineYAMLList(val)
+			default:
+				return nil, fmt.Errorf("line %d: unknown pin field %q", lineNum+1, key)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unexpected indented line outside of a section: %q", lineNum+1, trimmed)
+		}
+	}
+	flushPin()
+
+	return cfg, nil
+}
+
+func stripYAMLComment(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+func unquoteYAML(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"' || s[0] == '\'' && s[len(s)-1] == '\'') {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseInlineYAMLList parses "[a, b, \"c d\"]" style inline lists, splitting
+// on commas outside of quotes so that a quoted item like "a, b" isn't split
+// in two.
+func parseInlineYAMLList(s string) []string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "[")
+	s = strings.TrimSuffix(s, "]")
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var out []string
+	var quote rune
+	start := 0
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			out = append(out, unquoteYAML(s[start:i]))
+			start = i + 1
+		}
+	}
+	out = append(out, unquoteYAML(s[start:]))
+	return out
+}
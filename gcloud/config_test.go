@@ -0,0 +1,158 @@
+/*
+Copyright 2016 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStructuredConfig(t *testing.T) {
+	data := []byte(`
+default_version: prod
+
+versions:
+  beta: /opt/sdks/beta-track
+  prod: 459.0.0
+
+pins:
+  - pattern: gcloud beta run deploy
+    version: prod
+    extra_args: [--quiet, "--project=a, b"]
+    env:
+      CLOUDSDK_CORE_PROJECT: my-project
+  - pattern: gcloud alpha
+    version: beta
+
+plugins:
+  - kubectl
+  - app-engine-python
+`)
+
+	cfg, err := parseStructuredConfig(data)
+	if err != nil {
+		t.Fatalf("parseStructuredConfig() error = %v", err)
+	}
+
+	if got, want := cfg.DefaultVersion, "prod"; got != want {
+		t.Errorf("DefaultVersion = %q, want %q", got, want)
+	}
+	wantVersions := map[string]string{"beta": "/opt/sdks/beta-track", "prod": "459.0.0"}
+	if !reflect.DeepEqual(cfg.Versions, wantVersions) {
+		t.Errorf("Versions = %v, want %v", cfg.Versions, wantVersions)
+	}
+	if got, want := len(cfg.Pins), 2; got != want {
+		t.Fatalf("len(Pins) = %d, want %d", got, want)
+	}
+
+	first := cfg.Pins[0]
+	if got, want := first.Pattern, "gcloud beta run deploy"; got != want {
+		t.Errorf("Pins[0].Pattern = %q, want %q", got, want)
+	}
+	if got, want := first.Version, "prod"; got != want {
+		t.Errorf("Pins[0].Version = %q, want %q", got, want)
+	}
+	wantExtraArgs := []string{"--quiet", "--project=a, b"}
+	if !reflect.DeepEqual(first.ExtraArgs, wantExtraArgs) {
+		t.Errorf("Pins[0].ExtraArgs = %q, want %q", first.ExtraArgs, wantExtraArgs)
+	}
+	wantEnv := map[string]string{"CLOUDSDK_CORE_PROJECT": "my-project"}
+	if !reflect.DeepEqual(first.Env, wantEnv) {
+		t.Errorf("Pins[0].Env = %v, want %v", first.Env, wantEnv)
+	}
+
+	second := cfg.Pins[1]
+	if got, want := second.Pattern, "gcloud alpha"; got != want {
+		t.Errorf("Pins[1].Pattern = %q, want %q", got, want)
+	}
+	if len(second.ExtraArgs) != 0 {
+		t.Errorf("Pins[1].ExtraArgs = %q, want empty", second.ExtraArgs)
+	}
+
+	wantPlugins := []string{"kubectl", "app-engine-python"}
+	if !reflect.DeepEqual(cfg.Plugins, wantPlugins) {
+		t.Errorf("Plugins = %q, want %q", cfg.Plugins, wantPlugins)
+	}
+}
+
+func TestParseStructuredConfigMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "unrecognized top-level key",
+			data: "bogus: value\n",
+		},
+		{
+			name: "malformed versions entry",
+			data: "versions:\n  beta\n",
+		},
+		{
+			name: "malformed plugins entry",
+			data: "plugins:\n  kubectl\n",
+		},
+		{
+			name: "pin field outside of a list item",
+			data: "pins:\n  pattern: gcloud beta\n",
+		},
+		{
+			name: "malformed pin entry",
+			data: "pins:\n  - pattern\n",
+		},
+		{
+			name: "unknown pin field",
+			data: "pins:\n  - bogus: value\n",
+		},
+		{
+			name: "malformed env entry",
+			data: "pins:\n  - pattern: gcloud beta\n    env:\n      FOO\n",
+		},
+		{
+			name: "indented line outside of a section",
+			data: "  indented: value\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseStructuredConfig([]byte(tt.data)); err == nil {
+				t.Errorf("parseStructuredConfig(%q) error = nil, want an error", tt.data)
+			}
+		})
+	}
+}
+
+func TestParseInlineYAMLList(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{name: "empty", in: "[]", want: nil},
+		{name: "bare words", in: "[a, b]", want: []string{"a", "b"}},
+		{name: "quoted comma is not a separator", in: `[a, "b, c"]`, want: []string{"a", "b, c"}},
+		{name: "single quoted", in: "['a', 'b']", want: []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseInlineYAMLList(tt.in)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseInlineYAMLList(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
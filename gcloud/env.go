@@ -0,0 +1,39 @@
+/*
+Copyright 2016 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import "os"
+
+// envAccessor abstracts environment variable access so that mapCommand and
+// prepareEnvForCompletion - which both read and rewrite COMP_LINE/COMP_POINT
+// style state - can be exercised in tests without touching the real
+// process environment.
+type envAccessor interface {
+	Getenv(key string) string
+	Setenv(key, value string)
+}
+
+// osEnv is the envAccessor backed by the real process environment, used
+// outside of tests.
+type osEnv struct{}
+
+func (osEnv) Getenv(key string) string { return os.Getenv(key) }
+func (osEnv) Setenv(key, value string) { os.Setenv(key, value) }
+
+// mapEnv is an in-memory envAccessor for tests.
+type mapEnv map[string]string
+
+func (m mapEnv) Getenv(key string) string { return m[key] }
+func (m mapEnv) Setenv(key, value string) { m[key] = value }
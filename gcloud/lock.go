@@ -0,0 +1,74 @@
+/*
+Copyright 2016 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// The advisory lock guarding pins.cfg and the versions directory, so
+	// that e.g. a shell completion firing mid-install doesn't read a
+	// half-written pins file or run against a half-cloned SDK.
+	lockFile = "pincloud.lock"
+	// How long to wait for the lock before giving up.
+	lockTimeout = 30 * time.Second
+	// How often to retry a contended lock.
+	lockRetryInterval = 50 * time.Millisecond
+)
+
+func lockPath() string {
+	return filepath.Join(getConfigDirectory(), lockFile)
+}
+
+// acquireLock takes the pincloud advisory lock in shared or exclusive mode,
+// retrying until it succeeds or lockTimeout elapses. Callers must release
+// the returned file with releaseLock.
+func acquireLock(exclusive bool) (*os.File, error) {
+	if err := os.MkdirAll(getConfigDirectory(), 0755); err != nil {
+		return nil, fmt.Errorf("could not create %q: %v", getConfigDirectory(), err)
+	}
+	f, err := os.OpenFile(lockPath(), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file %q: %v", lockPath(), err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("could not acquire lock on %q within %s; another pincloud process is probably running", lockPath(), lockTimeout)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+func releaseLock(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
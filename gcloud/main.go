@@ -3,7 +3,9 @@ Copyright 2016 Google Inc. All rights reserved.
 Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
 You may obtain a copy of the License at
-    http://www.apache.org/licenses/LICENSE-2.0
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
 Unless required by applicable law or agreed to in writing, software
 distributed under the License is distributed on an "AS IS" BASIS,
 WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
@@ -48,103 +50,244 @@ const (
 )
 
 func main() {
+	os.Exit(Run(os.Args, osEnv{}, os.Stdin, os.Stdout, os.Stderr))
+}
 
+// Run is the real body of main, pulled out so that the command-mapping
+// logic below it can be driven from tests without exiting the test
+// process. It returns the process exit code rather than calling os.Exit
+// itself; the pincloud management subcommands handled by pincloudCommand
+// exit the process via log.Fatalf on failure. env is used for COMP_LINE,
+// COMP_POINT and per-pin overrides; the config and versions directories
+// and PATH are read from the process environment.
+func Run(args []string, env envAccessor, stdin io.Reader, stdout, stderr io.Writer) int {
 	// If it's a special pincloud management command, don't forward to gcloud.
-	if pincloudCommand() {
-		return
+	if pincloudCommand(args) {
+		return 0
 	}
 
-	fin, err := os.Open(getPinsPath())
-	if err != nil {
-		log.Fatalf("Could not open pin config: %v.", err)
-	}
-	plist, err := loadPins(fin)
+	plist, defaultGcloud, err := loadPinConfig()
 	if err != nil {
-		log.Fatalf("Could not load pins: %v.", err)
+		fmt.Fprintf(stderr, "Could not load pins: %v.\n", err)
+		return 1
 	}
 
-	commandArgs := os.Args
-	if compLine := os.Getenv("COMP_LINE"); compLine != "" {
+	commandArgs := args
+	if compLine := env.Getenv("COMP_LINE"); compLine != "" {
 		shlexed, err := shlex(compLine)
 		if err == nil {
 			commandArgs = shlexed
 		}
 	}
 
-	args, err := plist.mapCommand(commandArgs)
+	mappedArgs, err := plist.mapCommand(commandArgs, defaultGcloud, env)
 	if err != nil {
-		log.Fatalf("Could not map command: %v.", err)
+		fmt.Fprintf(stderr, "Could not map command: %v.\n", err)
+		return 1
 	}
 
-	if info, err := os.Stat(args[0]); err != nil {
-		log.Fatalf("Invalid pin: %q does not exist.", args[0])
+	if info, err := os.Stat(mappedArgs[0]); err != nil {
+		fmt.Fprintf(stderr, "Invalid pin: %q does not exist.\n", mappedArgs[0])
+		return 1
 	} else if info.IsDir() {
-		log.Fatalf("Invalid pin: %q is a directory.", args[0])
+		fmt.Fprintf(stderr, "Invalid pin: %q is a directory.\n", mappedArgs[0])
+		return 1
 	}
 
-	log.Printf("Using %q", args[0])
+	fmt.Fprintf(stderr, "Using %q\n", mappedArgs[0])
 
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
+	cmd := exec.Command(mappedArgs[0], mappedArgs[1:]...)
+	cmd.Stdin = stdin
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
 	if err := cmd.Run(); err != nil {
 		if err, ok := err.(*exec.ExitError); ok {
 			if status, ok := err.Sys().(syscall.WaitStatus); ok {
-				os.Exit(status.ExitStatus())
+				return status.ExitStatus()
 			}
 		}
 		// Oh well, use 1.
-		os.Exit(1)
+		return 1
 	}
+	return 0
 }
 
-func pincloudCommand() bool {
-	if len(os.Args) == 1 || os.Args[1] != "pincloud" {
-		return false
+const pincloudUsage = "Usage: %s pincloud {install VERSION [--mode=copy|hardlink|fresh],remove VERSION} | {list,available,gc} | use PATTERN VERSION"
+
+// parseInstallArgs splits the args following "install" into the version
+// token and an optional --mode flag.
+func parseInstallArgs(args []string) (token, mode string, err error) {
+	for _, a := range args {
+		if strings.HasPrefix(a, "--mode=") {
+			if mode != "" {
+				return "", "", fmt.Errorf("--mode given more than once")
+			}
+			mode = strings.TrimPrefix(a, "--mode=")
+			continue
+		}
+		if token != "" {
+			return "", "", fmt.Errorf("too many arguments to install: %q", a)
+		}
+		token = a
+	}
+	if token == "" {
+		return "", "", fmt.Errorf("install requires a VERSION")
+	}
+	switch mode {
+	case "", cloneModeCopy, cloneModeHardlink, cloneModeFresh:
+	default:
+		return "", "", fmt.Errorf("unknown --mode %q", mode)
 	}
+	return token, mode, nil
+}
 
-	if len(os.Args) != 4 {
-		log.Fatalf("Usage: %s pincloud {install,remove} VERSION", os.Args[0])
+func pincloudCommand(args []string) bool {
+	if len(args) == 1 || args[1] != "pincloud" {
+		return false
+	}
+	if len(args) < 3 {
+		log.Fatalf(pincloudUsage, args[0])
 	}
 
-	version := os.Args[3]
-	switch os.Args[2] {
+	switch args[2] {
 	case "install":
-		versionsDir := getVersionsDirectory()
-		versionDir := filepath.Join(versionsDir, version)
-		if _, err := os.Stat(versionDir); err == nil {
-			log.Fatalf("Something is in the way at %q.", versionDir)
+		if len(args) < 4 {
+			log.Fatalf(pincloudUsage, args[0])
 		}
-		sdkDir, ok := getDefaultSDK()
-		if !ok {
-			log.Fatalf("Could not find the default SDK to clone.")
+		token, mode, err := parseInstallArgs(args[3:])
+		if err != nil {
+			log.Fatalf("%v", err)
 		}
-
-		if err := os.MkdirAll(versionsDir, 0755); err != nil {
-			log.Fatalf("Could not create %q: %v", versionsDir, err)
+		if err := installVersion(token, mode); err != nil {
+			log.Fatalf("%v", err)
+		}
+	case "remove":
+		if len(args) != 4 {
+			log.Fatalf(pincloudUsage, args[0])
+		}
+		removeVersion(args[3])
+	case "list":
+		if len(args) != 3 {
+			log.Fatalf(pincloudUsage, args[0])
+		}
+		listVersions()
+	case "available":
+		if len(args) != 3 {
+			log.Fatalf(pincloudUsage, args[0])
 		}
-		log.Print("Cloning the default SDK.")
-		if err := exec.Command("cp", "-r", sdkDir, versionDir).Run(); err != nil {
-			log.Fatalf("Could not clone default SDK: %v", err)
+		availableVersions()
+	case "use":
+		if len(args) != 5 {
+			log.Fatalf(pincloudUsage, args[0])
 		}
+		useVersion(args[3], args[4])
+	case "gc":
+		if len(args) != 3 {
+			log.Fatalf(pincloudUsage, args[0])
+		}
+		gcVersions()
+	default:
+		log.Fatalf(pincloudUsage, args[0])
+	}
+
+	return true
+}
+
+// installVersion resolves token (an explicit version, or "latest"/"stable")
+// and lays out an SDK from the default one into getVersionsDirectory() under
+// that resolved version via cloneSDK; except in fresh mode, the clone is then
+// updated to that version via gcloud components. The
+// clone is built in a temporary sibling directory and only moved into place
+// once it's known-good, so an aborted or failed clone never leaves a broken
+// tree that blocks a later reinstall. Every failure returns an error instead
+// of calling log.Fatalf directly, so the deferred cleanup of that temporary
+// directory actually runs before the process exits.
+func installVersion(token, mode string) error {
+	lock, err := acquireLock(true)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(lock)
+
+	version, err := resolveVersionToken(token)
+	if err != nil {
+		return fmt.Errorf("could not resolve version %q: %v", token, err)
+	}
+
+	versionsDir := getVersionsDirectory()
+	versionDir := filepath.Join(versionsDir, version)
+	if _, err := os.Stat(versionDir); err == nil {
+		return fmt.Errorf("something is in the way at %q", versionDir)
+	}
+	sdkDir, ok := getDefaultSDK()
+	if !ok {
+		return fmt.Errorf("could not find the default SDK to clone")
+	}
+
+	if err := os.MkdirAll(versionsDir, 0755); err != nil {
+		return fmt.Errorf("could not create %q: %v", versionsDir, err)
+	}
+
+	tmpDir, err := ioutil.TempDir(versionsDir, ".pincloud-install-")
+	if err != nil {
+		return fmt.Errorf("could not create temp dir in %q: %v", versionsDir, err)
+	}
+	cloneDir := filepath.Join(tmpDir, version)
+	defer os.RemoveAll(tmpDir)
+
+	log.Printf("Cloning the default SDK (mode=%s).", modeOrDefault(mode))
+	if err := cloneSDK(mode, sdkDir, cloneDir, version); err != nil {
+		return fmt.Errorf("could not clone default SDK: %v", err)
+	}
+
+	if mode != cloneModeFresh {
 		log.Printf("Updating the cloned SDK to version %s.", version)
-		updateCmd := exec.Command(filepath.Join(versionDir, "bin", "gcloud"), "components", "update", "-q", "--version", version)
+		updateCmd := exec.Command(filepath.Join(cloneDir, "bin", "gcloud"), "components", "update", "-q", "--version", version)
 		updateCmd.Stdout = os.Stdout
 		updateCmd.Stderr = os.Stderr
 		if err := updateCmd.Run(); err != nil {
-			log.Fatalf("Could not update cloned SDK: %v", err)
+			return fmt.Errorf("could not update cloned SDK: %v", err)
 		}
-		log.Print("Install complete. Ignore the warnings about old versions of the tools.")
-	case "remove":
-		if err := os.RemoveAll(filepath.Join(getVersionsDirectory(), version)); err != nil {
-			log.Fatalf("Error removing version %q: %v", version, err)
+	}
+
+	if plugins := structuredConfigPlugins(); len(plugins) > 0 {
+		log.Printf("Installing configured plugins: %s.", strings.Join(plugins, ", "))
+		installCmd := exec.Command(filepath.Join(cloneDir, "bin", "gcloud"), append([]string{"components", "install", "-q"}, plugins...)...)
+		installCmd.Stdout = os.Stdout
+		installCmd.Stderr = os.Stderr
+		if err := installCmd.Run(); err != nil {
+			return fmt.Errorf("could not install configured plugins: %v", err)
 		}
-	default:
-		log.Fatalf("Usage: %s pincloud {install,remove} VERSION", os.Args[0])
 	}
 
-	return true
+	if err := checkInstalledVersion(cloneDir, version); err != nil {
+		return fmt.Errorf("install did not produce a working SDK, rolling back: %v", err)
+	}
+
+	if err := os.Rename(cloneDir, versionDir); err != nil {
+		return fmt.Errorf("could not move cloned SDK into place at %q: %v", versionDir, err)
+	}
+	log.Print("Install complete. Ignore the warnings about old versions of the tools.")
+	return nil
+}
+
+func modeOrDefault(mode string) string {
+	if mode == "" {
+		return cloneModeCopy
+	}
+	return mode
+}
+
+func removeVersion(version string) {
+	lock, err := acquireLock(true)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer releaseLock(lock)
+
+	if err := os.RemoveAll(filepath.Join(getVersionsDirectory(), version)); err != nil {
+		log.Fatalf("Error removing version %q: %v", version, err)
+	}
 }
 
 func getConfigDirectory() string {
@@ -169,33 +312,35 @@ func getPinsPath() string {
 	return filepath.Join(getConfigDirectory(), "pins.cfg")
 }
 
-func shlex(s string) ([]string, error) {
-	// TODO: real shlexing.
-	return strings.Split(strings.TrimSpace(s), " "), nil
-}
-
 type Pin struct {
 	Pattern []string
 	Args    []string
+	// Env holds per-pin environment variable overrides, populated only
+	// when the pin came from the structured pincloud.yaml config.
+	Env map[string]string
 }
 
 type PinList []Pin
 
-func loadPins(r io.Reader) (PinList, error) {
+// loadPinsLocked parses the legacy pins.cfg format from r. Callers are
+// expected to already be holding the pincloud lock (e.g. via
+// loadPinConfig/loadPinConfigLocked), since flock doesn't nest within a
+// single process.
+func loadPinsLocked(r io.Reader) (PinList, error) {
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, fmt.Errorf("could not read pin data: %v", err)
 	}
 	lines := strings.Split(string(data), "\n")
 	var plist PinList
-	for _, l := range lines {
+	for lineNum, l := range lines {
 		l = strings.TrimSpace(l)
 		if len(l) == 0 || l[0] == '#' {
 			continue
 		}
 		tokens := strings.SplitN(l, ":", 2)
 		if len(tokens) != 2 {
-			return nil, fmt.Errorf("not of form 'PATTERN:ARGS': %q", l)
+			return nil, fmt.Errorf("line %d: not of form 'PATTERN:ARGS': %q", lineNum+1, l)
 		}
 
 		var p Pin
@@ -203,24 +348,31 @@ func loadPins(r io.Reader) (PinList, error) {
 
 		p.Pattern, err = shlex(tokens[0])
 		if err != nil {
-			return nil, fmt.Errorf("could not shlex %q: %v", tokens[0], err)
+			return nil, fmt.Errorf("line %d: could not shlex %q: %v", lineNum+1, tokens[0], err)
 		}
 		if len(p.Pattern) == 0 {
-			return nil, fmt.Errorf("zero-len pattern in %q", l)
+			return nil, fmt.Errorf("line %d: zero-len pattern in %q", lineNum+1, l)
 		}
 		if p.Pattern[0] != "gcloud" {
-			return nil, fmt.Errorf("first token in pattern must be 'gcloud', not %q", p.Pattern[0])
+			return nil, fmt.Errorf("line %d: first token in pattern must be 'gcloud', not %q", lineNum+1, p.Pattern[0])
 		}
 
 		p.Args, err = shlex(tokens[1])
 		if err != nil {
-			return nil, fmt.Errorf("could not shlex %q: %v", tokens[1], err)
+			return nil, fmt.Errorf("line %d: could not shlex %q: %v", lineNum+1, tokens[1], err)
 		}
 		if len(p.Args) == 0 {
-			return nil, fmt.Errorf("zero-len args in %q", l)
+			return nil, fmt.Errorf("line %d: zero-len args in %q", lineNum+1, l)
 		}
-		// p.Args[0] is the sdk version to use. If it's not absolute, it's
+		// p.Args[0] is the sdk version to use. It may be the symbolic
+		// "latest" or "stable", which we re-resolve against the remote
+		// index every time pins are loaded. If it's not absolute, it's
 		// located in the versions directory.
+		resolved, err := resolveVersionToken(p.Args[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum+1, err)
+		}
+		p.Args[0] = resolved
 		if !filepath.IsAbs(p.Args[0]) {
 			p.Args[0] = filepath.Join(getVersionsDirectory(), p.Args[0])
 		}
@@ -232,11 +384,19 @@ func loadPins(r io.Reader) (PinList, error) {
 	return plist, nil
 }
 
-func (plist PinList) mapCommand(args []string) ([]string, error) {
+// mapCommand maps args onto a pinned gcloud invocation. defaultGcloud, if
+// non-empty, is used in place of getDefaultGcloud() when no pin matches; it
+// comes from the structured config's default_version, resolved by the
+// caller.
+func (plist PinList) mapCommand(args []string, defaultGcloud string, env envAccessor) ([]string, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no command given")
+	}
+
 	// Skip non-positionals.
 	var positionals []string
 	for _, arg := range args {
-		if arg[0] == '-' {
+		if len(arg) > 0 && arg[0] == '-' {
 			continue
 		}
 		positionals = append(positionals, arg)
@@ -280,7 +440,8 @@ plist:
 		// Prefix match, use this pin.
 		pinnedArgs := append([]string{}, p.Args...)
 		pinnedArgs = append(pinnedArgs, args[1:]...)
-		prepareEnvForCompletion(p.Args)
+		applyPinEnv(p, env)
+		prepareEnvForCompletion(p.Args, env)
 		return pinnedArgs, nil
 	}
 
@@ -288,18 +449,33 @@ plist:
 		// partial match, we still use it.
 		pinnedArgs := append([]string{}, partialPatternMatch.Args...)
 		pinnedArgs = append(pinnedArgs, args[1:]...)
-		prepareEnvForCompletion(partialPatternMatch.Args)
+		applyPinEnv(partialPatternMatch, env)
+		prepareEnvForCompletion(partialPatternMatch.Args, env)
 		return pinnedArgs, nil
 	}
 
-	// No patterns matched, so use the default gcloud.
-	gcloud, ok := getDefaultGcloud()
-	if !ok {
-		return nil, fmt.Errorf("no patterns matched, and no gcloud on path")
+	// No patterns matched, so use the configured default version, if any,
+	// else whatever gcloud is on $PATH.
+	gcloud := defaultGcloud
+	if gcloud == "" {
+		var ok bool
+		gcloud, ok = getDefaultGcloud()
+		if !ok {
+			return nil, fmt.Errorf("no patterns matched, and no gcloud on path")
+		}
 	}
 	return append([]string{gcloud}, args[1:]...), nil
 }
 
+// applyPinEnv sets any per-pin environment variable overrides so the
+// subsequent exec.Command (which inherits the process environment) sees
+// them.
+func applyPinEnv(p Pin, env envAccessor) {
+	for k, v := range p.Env {
+		env.Setenv(k, v)
+	}
+}
+
 // Get the first gcloud on the path that isn't this binary.
 // The heuristic is that the first line of the file is "#!/bin/sh".
 func getDefaultGcloud() (string, bool) {
@@ -311,7 +487,7 @@ func getDefaultGcloud() (string, bool) {
 		candidateGcloud := filepath.Join(pd, "gcloud")
 		cin, err := os.Open(candidateGcloud)
 		if err != nil {
-			log.Print("Could not open candidate gcloud %q: %v", candidateGcloud, err)
+			log.Printf("Could not open candidate gcloud %q: %v", candidateGcloud, err)
 			continue
 		}
 		buf := make([]byte, len(symbol))
@@ -341,13 +517,13 @@ func getDefaultSDK() (string, bool) {
 	return strings.TrimSpace(string(data)), true
 }
 
-func prepareEnvForCompletion(args []string) {
-	compLine := os.Getenv("COMP_LINE")
+func prepareEnvForCompletion(args []string, env envAccessor) {
+	compLine := env.Getenv("COMP_LINE")
 	if compLine == "" {
 		// COMP_LINE not set, must not be doing completion.
 		return
 	}
-	point, err := strconv.Atoi(os.Getenv("COMP_POINT"))
+	point, err := strconv.Atoi(env.Getenv("COMP_POINT"))
 	if err != nil {
 		return
 	}
@@ -357,8 +533,8 @@ func prepareEnvForCompletion(args []string) {
 		return
 	}
 
-	words := strings.SplitN(compLine, " ", 2)
-	if len(words) == 0 {
+	words, err := shlex(compLine)
+	if err != nil || len(words) == 0 {
 		return
 	}
 
@@ -366,10 +542,10 @@ func prepareEnvForCompletion(args []string) {
 
 	newWords := append([]string{words[0]}, args[1:]...)
 	newWords = append(newWords, words[1:]...)
-	compLine = strings.Join(newWords, " ")
+	compLine = shlexJoin(newWords)
 
 	newLen := len(compLine)
 	point += newLen - oldLen
-	os.Setenv("COMP_LINE", compLine)
-	os.Setenv("COMP_POINT", fmt.Sprint(point))
+	env.Setenv("COMP_LINE", compLine)
+	env.Setenv("COMP_POINT", fmt.Sprint(point))
 }
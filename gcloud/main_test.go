@@ -0,0 +1,213 @@
+/*
+Copyright 2016 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestMapCommand(t *testing.T) {
+	// mapCommand uses the first prefix match in list order, so a more
+	// specific pattern like "beta run deploy" has to come before the
+	// "beta run" pattern it collides with or it will never be reached.
+	plist := PinList{
+		{Pattern: []string{"gcloud", "beta", "run", "deploy"}, Args: []string{"/v/run-deploy/bin/gcloud", "--quiet"}},
+		{Pattern: []string{"gcloud", "beta", "run"}, Args: []string{"/v/run/bin/gcloud"}},
+		{Pattern: []string{"gcloud", "alpha"}, Args: []string{"/v/alpha/bin/gcloud"}},
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "more specific pattern matches before its own prefix",
+			args: []string{"gcloud", "beta", "run", "deploy", "myservice"},
+			want: []string{"/v/run-deploy/bin/gcloud", "--quiet", "beta", "run", "deploy", "myservice"},
+		},
+		{
+			name: "shorter pattern matches when the longer one doesn't apply",
+			args: []string{"gcloud", "beta", "run", "services", "list"},
+			want: []string{"/v/run/bin/gcloud", "beta", "run", "services", "list"},
+		},
+		{
+			name: "flags in the middle of the command are ignored for matching",
+			args: []string{"gcloud", "--verbosity=debug", "beta", "run", "deploy", "--quiet", "myservice"},
+			want: []string{"/v/run-deploy/bin/gcloud", "--quiet", "--verbosity=debug", "beta", "run", "deploy", "--quiet", "myservice"},
+		},
+		{
+			name: "partial match on the last word falls back to the closest pin",
+			args: []string{"gcloud", "alp"},
+			want: []string{"/v/alpha/bin/gcloud", "alp"},
+		},
+		{
+			name:    "no match and no default gcloud errors out",
+			args:    []string{"gcloud", "compute", "instances", "list"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := mapEnv{}
+			got, err := plist.mapCommand(tt.args, "", env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mapCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mapCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMapCommandEmptyArg documents that an empty-string positional (e.g. from
+// a quoted "" on the command line) doesn't panic when mapCommand skips flags.
+func TestMapCommandEmptyArg(t *testing.T) {
+	plist := PinList{
+		{Pattern: []string{"gcloud", "beta", "run", "deploy"}, Args: []string{"/v/run-deploy/bin/gcloud"}},
+	}
+
+	got, err := plist.mapCommand([]string{"gcloud", "beta", "run", "", "deploy"}, "", mapEnv{})
+	if err != nil {
+		t.Fatalf("mapCommand() error = %v", err)
+	}
+	want := []string{"/v/run-deploy/bin/gcloud", "beta", "run", "", "deploy"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mapCommand() = %q, want %q", got, want)
+	}
+}
+
+// TestMapCommandEmptyArgs documents that a whitespace-only COMP_LINE, which
+// shlex reduces to a zero-length slice, errors out instead of panicking on
+// args[1:] in the no-match/default-gcloud branch.
+func TestMapCommandEmptyArgs(t *testing.T) {
+	plist := PinList{
+		{Pattern: []string{"gcloud", "beta", "run"}, Args: []string{"/v/run/bin/gcloud"}},
+	}
+
+	if _, err := plist.mapCommand(nil, "/v/stable/bin/gcloud", mapEnv{}); err == nil {
+		t.Fatalf("mapCommand() error = nil, want an error for zero args")
+	}
+}
+
+// TestMapCommandPatternOrderCollision documents that mapCommand resolves a
+// prefix collision by list order, not by specificity: whichever pattern
+// comes first in pins.cfg wins, even if a later pattern would have been a
+// more specific match.
+func TestMapCommandPatternOrderCollision(t *testing.T) {
+	plist := PinList{
+		{Pattern: []string{"gcloud", "beta", "run"}, Args: []string{"/v/run/bin/gcloud"}},
+		{Pattern: []string{"gcloud", "beta", "run", "deploy"}, Args: []string{"/v/run-deploy/bin/gcloud"}},
+	}
+
+	got, err := plist.mapCommand([]string{"gcloud", "beta", "run", "deploy", "myservice"}, "", mapEnv{})
+	if err != nil {
+		t.Fatalf("mapCommand() error = %v", err)
+	}
+	want := []string{"/v/run/bin/gcloud", "beta", "run", "deploy", "myservice"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mapCommand() = %q, want %q", got, want)
+	}
+}
+
+func TestMapCommandDefaultVersion(t *testing.T) {
+	plist := PinList{
+		{Pattern: []string{"gcloud", "beta", "run"}, Args: []string{"/v/run/bin/gcloud"}},
+	}
+
+	got, err := plist.mapCommand([]string{"gcloud", "compute", "instances", "list"}, "/v/stable/bin/gcloud", mapEnv{})
+	if err != nil {
+		t.Fatalf("mapCommand() error = %v", err)
+	}
+	want := []string{"/v/stable/bin/gcloud", "compute", "instances", "list"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mapCommand() = %q, want %q", got, want)
+	}
+}
+
+func TestMapCommandAppliesPinEnv(t *testing.T) {
+	plist := PinList{
+		{
+			Pattern: []string{"gcloud", "beta", "run"},
+			Args:    []string{"/v/run/bin/gcloud"},
+			Env:     map[string]string{"CLOUDSDK_CORE_PROJECT": "my-project"},
+		},
+	}
+
+	env := mapEnv{}
+	if _, err := plist.mapCommand([]string{"gcloud", "beta", "run"}, "", env); err != nil {
+		t.Fatalf("mapCommand() error = %v", err)
+	}
+	if got, want := env.Getenv("CLOUDSDK_CORE_PROJECT"), "my-project"; got != want {
+		t.Errorf("CLOUDSDK_CORE_PROJECT = %q, want %q", got, want)
+	}
+}
+
+func TestPrepareEnvForCompletion(t *testing.T) {
+	tests := []struct {
+		name         string
+		pinArgs      []string
+		compLine     string
+		compPoint    string
+		wantCompLine string
+		wantPoint    int
+	}{
+		{
+			name:         "no release track means no rewrite",
+			pinArgs:      []string{"/v/run/bin/gcloud"},
+			compLine:     "gcloud beta run deploy my",
+			compPoint:    "26",
+			wantCompLine: "gcloud beta run deploy my",
+			wantPoint:    26,
+		},
+		{
+			name:         "inserted release track shifts COMP_POINT forward",
+			pinArgs:      []string{"/v/run/bin/gcloud", "beta"},
+			compLine:     "gcloud run deploy my",
+			compPoint:    "20",
+			wantCompLine: "gcloud beta run deploy my",
+			wantPoint:    25,
+		},
+		{
+			name:         "inserted args needing quoting round-trip",
+			pinArgs:      []string{"/v/run/bin/gcloud", "--project=a b"},
+			compLine:     "gcloud run deploy my",
+			compPoint:    "20",
+			wantCompLine: `gcloud '--project=a b' run deploy my`,
+			wantPoint:    36,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := mapEnv{"COMP_LINE": tt.compLine, "COMP_POINT": tt.compPoint}
+			prepareEnvForCompletion(tt.pinArgs, env)
+			if got := env.Getenv("COMP_LINE"); got != tt.wantCompLine {
+				t.Errorf("COMP_LINE = %q, want %q", got, tt.wantCompLine)
+			}
+			if got := env.Getenv("COMP_POINT"); got != strconv.Itoa(tt.wantPoint) {
+				t.Errorf("COMP_POINT = %q, want %d", got, tt.wantPoint)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2016 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// listVersions prints every version installed under getVersionsDirectory(),
+// alongside the version its gcloud binary actually reports.
+func listVersions() {
+	versionsDir := getVersionsDirectory()
+	entries, err := ioutil.ReadDir(versionsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		log.Fatalf("Could not read %q: %v", versionsDir, err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		gcloud := filepath.Join(versionsDir, e.Name(), "bin", "gcloud")
+		reported, err := reportedGcloudVersion(gcloud)
+		if err != nil {
+			fmt.Printf("%s\t(could not determine version: %v)\n", e.Name(), err)
+			continue
+		}
+		fmt.Printf("%s\t%s\n", e.Name(), reported)
+	}
+}
+
+// reportedGcloudVersion shells out to the given gcloud binary and extracts
+// the Cloud SDK version from its --format=json output.
+func reportedGcloudVersion(gcloud string) (string, error) {
+	out, err := exec.Command(gcloud, "version", "--format=json").Output()
+	if err != nil {
+		return "", err
+	}
+	var parsed struct {
+		GoogleCloudSDK string `json:"Google Cloud SDK"`
+	}
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return "", fmt.Errorf("could not parse gcloud version output: %v", err)
+	}
+	if parsed.GoogleCloudSDK == "" {
+		return "", fmt.Errorf("gcloud version output did not include a Google Cloud SDK version")
+	}
+	return parsed.GoogleCloudSDK, nil
+}
+
+// availableVersions prints the versions known to the remote index, newest
+// first.
+func availableVersions() {
+	idx, err := getVersionIndex()
+	if err != nil {
+		log.Fatalf("Could not fetch available versions: %v", err)
+	}
+	for _, v := range sortedVersionsDescending(idx.Versions) {
+		if v == idx.Stable {
+			fmt.Printf("%s\t(stable)\n", v)
+		} else {
+			fmt.Println(v)
+		}
+	}
+}
+
+// useVersion appends or replaces the pin for pattern in the pins file with
+// version, preserving any extra args already present on that line.
+func useVersion(pattern, version string) {
+	lock, err := acquireLock(true)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer releaseLock(lock)
+
+	path := getPinsPath()
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Could not read %q: %v", path, err)
+	}
+	lines := strings.Split(string(data), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		lines = nil
+	}
+
+	patternTokens, err := shlex(pattern)
+	if err != nil {
+		log.Fatalf("Could not parse pattern %q: %v", pattern, err)
+	}
+
+	replaced := false
+	for i, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		if trimmed == "" || trimmed[0] == '#' {
+			continue
+		}
+		tokens := strings.SplitN(trimmed, ":", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		existingPattern, err := shlex(tokens[0])
+		if err != nil || shlexJoin(existingPattern) != shlexJoin(patternTokens) {
+			continue
+		}
+		existingArgs, err := shlex(tokens[1])
+		if err != nil || len(existingArgs) == 0 {
+			existingArgs = []string{version}
+		} else {
+			existingArgs[0] = version
+		}
+		lines[i] = shlexJoin(patternTokens) + ":" + shlexJoin(existingArgs)
+		replaced = true
+		break
+	}
+	if !replaced {
+		lines = append(lines, shlexJoin(patternTokens)+":"+version)
+	}
+
+	out := strings.Join(lines, "\n")
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatalf("Could not create %q: %v", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, []byte(out), 0644); err != nil {
+		log.Fatalf("Could not write %q: %v", path, err)
+	}
+}
+
+// gcVersions removes every installed version that isn't referenced by a pin
+// (from pincloud.yaml if present, else pins.cfg) or by the structured
+// config's default_version.
+func gcVersions() {
+	lock, err := acquireLock(true)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer releaseLock(lock)
+
+	plist, defaultGcloud, err := loadPinConfigLocked()
+	if err != nil {
+		log.Fatalf("Could not load pins: %v", err)
+	}
+
+	referenced := map[string]bool{}
+	for _, p := range plist {
+		// p.Args[0] has already been resolved to ".../bin/gcloud"; its
+		// grandparent directory is the version directory.
+		referenced[filepath.Dir(filepath.Dir(p.Args[0]))] = true
+	}
+	if defaultGcloud != "" {
+		referenced[filepath.Dir(filepath.Dir(defaultGcloud))] = true
+	}
+
+	versionsDir := getVersionsDirectory()
+	entries, err := ioutil.ReadDir(versionsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		log.Fatalf("Could not read %q: %v", versionsDir, err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(versionsDir, e.Name())
+		if referenced[dir] {
+			continue
+		}
+		log.Printf("Removing unreferenced version %q.", e.Name())
+		if err := os.RemoveAll(dir); err != nil {
+			log.Fatalf("Could not remove %q: %v", dir, err)
+		}
+	}
+}
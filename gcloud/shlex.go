@@ -0,0 +1,142 @@
+/*
+Copyright 2016 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// shlex splits s the way a POSIX shell would when tokenizing a command
+// line: single-quoted strings are taken verbatim, double-quoted strings
+// allow backslash escapes for \, ", $ and newline, and a bare backslash
+// outside of quotes escapes the next character. Unquoted whitespace
+// separates tokens, and "" or ” produce an empty token rather than being
+// dropped, so that e.g. `--flag=""` round-trips.
+func shlex(s string) ([]string, error) {
+	var tokens []string
+	var cur strings.Builder
+	inToken := false
+
+	const (
+		none = iota
+		single
+		double
+	)
+	quote := none
+
+	flush := func() {
+		tokens = append(tokens, cur.String())
+		cur.Reset()
+		inToken = false
+	}
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch quote {
+		case single:
+			if c == '\'' {
+				quote = none
+				continue
+			}
+			cur.WriteRune(c)
+			continue
+		case double:
+			if c == '"' {
+				quote = none
+				continue
+			}
+			if c == '\\' && i+1 < len(runes) {
+				switch runes[i+1] {
+				case '\\', '"', '$', '\n':
+					cur.WriteRune(runes[i+1])
+					i++
+					continue
+				}
+			}
+			cur.WriteRune(c)
+			continue
+		}
+
+		switch {
+		case c == '\'':
+			quote = single
+			inToken = true
+		case c == '"':
+			quote = double
+			inToken = true
+		case c == '\\':
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("trailing backslash in %q", s)
+			}
+			i++
+			cur.WriteRune(runes[i])
+			inToken = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inToken {
+				flush()
+			}
+		default:
+			cur.WriteRune(c)
+			inToken = true
+		}
+	}
+
+	if quote != none {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inToken {
+		flush()
+	}
+
+	return tokens, nil
+}
+
+// shlexJoin is the inverse of shlex: it reconstructs a command line from
+// tokens, quoting any token that would otherwise not round-trip through
+// shlex (because it is empty or contains whitespace or quote characters).
+func shlexJoin(tokens []string) string {
+	quoted := make([]string, len(tokens))
+	for i, t := range tokens {
+		quoted[i] = shlexQuote(t)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shlexQuote quotes a single token for inclusion in a shlexJoin'd command
+// line, using single quotes (the only form with no escaping rules to get
+// wrong) whenever the token isn't already safe bare.
+func shlexQuote(t string) string {
+	if t != "" && !strings.ContainsAny(t, " \t\n'\"\\$") {
+		return t
+	}
+	if !strings.Contains(t, "'") {
+		return "'" + t + "'"
+	}
+	// Fall back to double quotes, escaping what double quotes treat
+	// specially.
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range t {
+		switch c {
+		case '"', '\\', '$':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
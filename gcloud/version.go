@@ -0,0 +1,187 @@
+/*
+Copyright 2016 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The public manifest of released Cloud SDK versions.
+	cloudSDKIndexURL = "https://dl.google.com/dl/cloudsdk/channels/rapid/component-versions.json"
+	// How long a cached copy of the index is trusted before being
+	// re-fetched. Overridable via indexTTLEnv, e.g. "10m", "24h".
+	defaultIndexTTL = time.Hour
+	// The name of the cached index file, under getConfigDirectory().
+	indexCacheFile = "version-index.json"
+	// Overrides defaultIndexTTL. Accepts anything time.ParseDuration does.
+	indexTTLEnv = "PINCLOUD_INDEX_TTL"
+
+	versionLatest = "latest"
+	versionStable = "stable"
+)
+
+// versionIndex is the cached/fetched shape of cloudSDKIndexURL: the full
+// list of released Cloud SDK versions, and which one the "stable" channel
+// currently points at.
+type versionIndex struct {
+	Versions  []string  `json:"versions"`
+	Stable    string    `json:"stable"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+func getIndexTTL() time.Duration {
+	if v := os.Getenv(indexTTLEnv); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return defaultIndexTTL
+}
+
+func indexCachePath() string {
+	return filepath.Join(getConfigDirectory(), indexCacheFile)
+}
+
+// fetchVersionIndex hits cloudSDKIndexURL for the current index, stamping
+// it with the fetch time so loadCachedIndex can honor the TTL later.
+func fetchVersionIndex() (*versionIndex, error) {
+	resp, err := http.Get(cloudSDKIndexURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch version index: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch version index: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read version index: %v", err)
+	}
+	var idx versionIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("could not parse version index: %v", err)
+	}
+	idx.FetchedAt = time.Now()
+	return &idx, nil
+}
+
+func loadCachedIndex() (*versionIndex, bool) {
+	data, err := ioutil.ReadFile(indexCachePath())
+	if err != nil {
+		return nil, false
+	}
+	var idx versionIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, false
+	}
+	if time.Since(idx.FetchedAt) > getIndexTTL() {
+		return nil, false
+	}
+	return &idx, true
+}
+
+func saveCachedIndex(idx *versionIndex) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(getConfigDirectory(), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(indexCachePath(), data, 0644)
+}
+
+// getVersionIndex returns the cached index if it's still within its TTL,
+// otherwise fetches a fresh one and refreshes the cache.
+func getVersionIndex() (*versionIndex, error) {
+	if idx, ok := loadCachedIndex(); ok {
+		return idx, nil
+	}
+	idx, err := fetchVersionIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := saveCachedIndex(idx); err != nil {
+		log.Printf("Could not cache version index: %v", err)
+	}
+	return idx, nil
+}
+
+// resolveVersionToken turns the symbolic tokens "latest" and "stable" into
+// a concrete Cloud SDK version, consulting the remote index. Any other
+// token is returned unchanged, so callers can pass through explicit
+// versions or absolute paths without a round trip.
+func resolveVersionToken(token string) (string, error) {
+	if token != versionLatest && token != versionStable {
+		return token, nil
+	}
+	idx, err := getVersionIndex()
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %q: %v", token, err)
+	}
+	if token == versionStable {
+		if idx.Stable == "" {
+			return "", fmt.Errorf("version index does not report a stable version")
+		}
+		return idx.Stable, nil
+	}
+	sorted := sortedVersionsDescending(idx.Versions)
+	if len(sorted) == 0 {
+		return "", fmt.Errorf("version index reports no versions")
+	}
+	return sorted[0], nil
+}
+
+// sortedVersionsDescending sorts semver-ish "X.Y.Z" version strings from
+// newest to oldest. Components that aren't numeric fall back to a plain
+// string comparison, so odd version strings degrade gracefully instead of
+// erroring out.
+func sortedVersionsDescending(versions []string) []string {
+	sorted := append([]string{}, versions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return versionLess(sorted[j], sorted[i])
+	})
+	return sorted
+}
+
+func versionLess(a, b string) bool {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		if aerr == nil && berr == nil {
+			if an != bn {
+				return an < bn
+			}
+			continue
+		}
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}